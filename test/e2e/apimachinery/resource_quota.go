@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -47,6 +48,7 @@ import (
 	"k8s.io/client-go/util/retry"
 	"k8s.io/kubernetes/pkg/quota/v1/evaluator/core"
 	"k8s.io/kubernetes/test/e2e/framework"
+	e2eskipper "k8s.io/kubernetes/test/e2e/framework/skipper"
 	"k8s.io/kubernetes/test/utils/crd"
 	imageutils "k8s.io/kubernetes/test/utils/image"
 	admissionapi "k8s.io/pod-security-admission/api"
@@ -1800,6 +1802,288 @@ var _ = SIGDescribe("ResourceQuota", func() {
 	})
 })
 
+var _ = SIGDescribe("ResourceQuota [Feature:InPlacePodVerticalScaling]", func() {
+	f := framework.NewDefaultFramework("resourcequota-pod-resize")
+	f.NamespacePodSecurityLevel = admissionapi.LevelBaseline
+
+	ginkgo.It("should recompute ResourceQuota usage on an in-place pod resize and reject a resize that would exceed quota", func(ctx context.Context) {
+		ginkgo.By("Creating a ResourceQuota with a CPU and memory limit")
+		quotaName := "test-quota-pod-resize"
+		resourceQuota := newTestResourceQuota(quotaName)
+		resourceQuota.Spec.Hard[v1.ResourceCPU] = resource.MustParse("700m")
+		resourceQuota.Spec.Hard[v1.ResourceMemory] = resource.MustParse("700Mi")
+		_, err := createResourceQuota(ctx, f.ClientSet, f.Namespace.Name, resourceQuota)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status is calculated")
+		usedResources := v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("0"),
+			v1.ResourceMemory: resource.MustParse("0"),
+		}
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Creating a Pod that fits quota")
+		requests := v1.ResourceList{v1.ResourceCPU: resource.MustParse("300m"), v1.ResourceMemory: resource.MustParse("300Mi")}
+		pod := newTestPodForQuota(f, "test-pod-resize", requests, requests)
+		// The container status resize fields checked below are only reported for
+		// a running pod, so this pod is allowed to schedule.
+		pod.Spec.NodeSelector = nil
+		pod.Spec.Containers[0].ResizePolicy = []v1.ContainerResizePolicy{
+			{ResourceName: v1.ResourceCPU, RestartPolicy: v1.NotRequired},
+			{ResourceName: v1.ResourceMemory, RestartPolicy: v1.NotRequired},
+		}
+		pod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(ctx, pod, metav1.CreateOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status captures the pod's initial usage")
+		usedResources[v1.ResourceCPU] = requests[v1.ResourceCPU]
+		usedResources[v1.ResourceMemory] = requests[v1.ResourceMemory]
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Resizing the pod up, staying within quota")
+		resizedRequests := v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m"), v1.ResourceMemory: resource.MustParse("500Mi")}
+		pod.Spec.Containers[0].Resources.Requests = resizedRequests
+		pod.Spec.Containers[0].Resources.Limits = resizedRequests
+		pod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Resize(ctx, pod.Name, pod, metav1.UpdateOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status is recomputed to the resized requests")
+		usedResources[v1.ResourceCPU] = resizedRequests[v1.ResourceCPU]
+		usedResources[v1.ResourceMemory] = resizedRequests[v1.ResourceMemory]
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring the pod's status AllocatedResources and actual Resources both settle on the resized requests")
+		err = waitForPodResizeStatusFields(ctx, f.ClientSet, f.Namespace.Name, pod.Name, resizedRequests)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Attempting to resize the pod beyond the remaining quota")
+		overQuotaRequests := v1.ResourceList{v1.ResourceCPU: resource.MustParse("1"), v1.ResourceMemory: resource.MustParse("1Gi")}
+		rejectedPod := pod.DeepCopy()
+		rejectedPod.Spec.Containers[0].Resources.Requests = overQuotaRequests
+		rejectedPod.Spec.Containers[0].Resources.Limits = overQuotaRequests
+		_, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Resize(ctx, rejectedPod.Name, rejectedPod, metav1.UpdateOptions{})
+		framework.ExpectError(err)
+
+		ginkgo.By("Ensuring the rejected resize did not mutate quota usage")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Shrinking the pod back down")
+		shrunkRequests := v1.ResourceList{v1.ResourceCPU: resource.MustParse("200m"), v1.ResourceMemory: resource.MustParse("200Mi")}
+		pod.Spec.Containers[0].Resources.Requests = shrunkRequests
+		pod.Spec.Containers[0].Resources.Limits = shrunkRequests
+		pod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Resize(ctx, pod.Name, pod, metav1.UpdateOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status reflects the smaller request")
+		usedResources[v1.ResourceCPU] = shrunkRequests[v1.ResourceCPU]
+		usedResources[v1.ResourceMemory] = shrunkRequests[v1.ResourceMemory]
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring the pod's status again settles on the shrunk Resources")
+		err = waitForPodResizeStatusFields(ctx, f.ClientSet, f.Namespace.Name, pod.Name, shrunkRequests)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Deleting the pod")
+		err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(ctx, pod.Name, *metav1.NewDeleteOptions(0))
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status released the pod usage")
+		usedResources[v1.ResourceCPU] = resource.MustParse("0")
+		usedResources[v1.ResourceMemory] = resource.MustParse("0")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+	})
+})
+
+// volumeSnapshotResource is the GroupVersionResource of the external
+// snapshotter's VolumeSnapshot CRD, accessed via the dynamic client the same
+// way the custom-resource quota test above accesses an arbitrary CRD.
+var volumeSnapshotResource = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}
+
+var _ = SIGDescribe("ResourceQuota [Feature:VolumeSnapshotDataSource]", func() {
+	f := framework.NewDefaultFramework("resourcequota-volumesnapshot")
+	f.NamespacePodSecurityLevel = admissionapi.LevelBaseline
+
+	ginkgo.It("should capture VolumeSnapshot counts via the generic object-count quota mechanism", func(ctx context.Context) {
+		countResourceName := v1.ResourceName("count/volumesnapshots.snapshot.storage.k8s.io")
+
+		ginkgo.By("Triggering resourcequota controller discovery of the volumesnapshots.snapshot.storage.k8s.io count resource")
+		// resourcequota controller needs to take 30 seconds at most to detect a
+		// newly countable resource, the same as for an arbitrary CRD above: create
+		// a throwaway quota and keep nudging it until the controller reports usage
+		// for the resource, then delete it before creating the quota this spec
+		// actually exercises.
+		discoveryQuotaName := "quota-for-volumesnapshots"
+		_, err := createResourceQuota(ctx, f.ClientSet, f.Namespace.Name, &v1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: discoveryQuotaName},
+			Spec: v1.ResourceQuotaSpec{
+				Hard: v1.ResourceList{
+					countResourceName: resource.MustParse("0"),
+				},
+			},
+		})
+		framework.ExpectNoError(err)
+		err = updateResourceQuotaUntilUsageAppears(ctx, f.ClientSet, f.Namespace.Name, discoveryQuotaName, countResourceName)
+		framework.ExpectNoError(err)
+		err = f.ClientSet.CoreV1().ResourceQuotas(f.Namespace.Name).Delete(ctx, discoveryQuotaName, metav1.DeleteOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Creating a ResourceQuota that limits the discovered volumesnapshots.snapshot.storage.k8s.io count")
+		quotaName := "test-quota-volumesnapshot"
+		resourceQuota := newTestResourceQuota(quotaName)
+		resourceQuota.Spec.Hard[countResourceName] = resource.MustParse("1")
+		_, err = createResourceQuota(ctx, f.ClientSet, f.Namespace.Name, resourceQuota)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status is calculated")
+		usedResources := v1.ResourceList{
+			countResourceName: resource.MustParse("0"),
+		}
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Creating a source PersistentVolumeClaim to snapshot")
+		pvc := newTestPersistentVolumeClaimForQuota("test-claim-for-snapshot")
+		pvc, err = f.ClientSet.CoreV1().PersistentVolumeClaims(f.Namespace.Name).Create(ctx, pvc, metav1.CreateOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Creating a VolumeSnapshot against the gold snapshot class")
+		snapshot := newTestVolumeSnapshotForQuota("test-snapshot", classGold, pvc.Name)
+		_, err = f.DynamicClient.Resource(volumeSnapshotResource).Namespace(f.Namespace.Name).Create(ctx, snapshot, metav1.CreateOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status captures the snapshot usage")
+		usedResources[countResourceName] = resource.MustParse("1")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Deleting the VolumeSnapshot")
+		err = f.DynamicClient.Resource(volumeSnapshotResource).Namespace(f.Namespace.Name).Delete(ctx, snapshot.GetName(), metav1.DeleteOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status released usage")
+		usedResources[countResourceName] = resource.MustParse("0")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+	})
+
+	ginkgo.It("should count a pod's container requests.ephemeral-storage unchanged by a CSI ephemeral inline volume", func(ctx context.Context) {
+		ginkgo.By("Creating a ResourceQuota with a requests.ephemeral-storage limit")
+		quotaName := "test-quota-ephemeral-volume"
+		resourceQuota := newTestResourceQuota(quotaName)
+		resourceQuota.Spec.Hard[v1.ResourceRequestsEphemeralStorage] = resource.MustParse("30Gi")
+		_, err := createResourceQuota(ctx, f.ClientSet, f.Namespace.Name, resourceQuota)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status is calculated")
+		usedResources := v1.ResourceList{
+			v1.ResourceRequestsEphemeralStorage: resource.MustParse("0"),
+		}
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Creating a pod with a CSI ephemeral inline volume")
+		// A CSI ephemeral inline volume (pod.Spec.Volumes[].CSI) is driver-managed,
+		// node-local storage with no accompanying PersistentVolumeClaim, unlike a
+		// PVC-backed generic ephemeral volume. It carries no resource request of
+		// its own, so a pod's
+		// requests.ephemeral-storage usage is driven solely by its containers'
+		// resource requests, same as for a pod with no such volume at all.
+		requests := v1.ResourceList{v1.ResourceEphemeralStorage: resource.MustParse("30Gi")}
+		pod := newTestPodForQuota(f, "pod-csi-ephemeral-volume", requests, v1.ResourceList{})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name: "csi-ephemeral-vol",
+			VolumeSource: v1.VolumeSource{
+				CSI: &v1.CSIVolumeSource{
+					Driver: "csi.example.com",
+				},
+			},
+		})
+		pod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(ctx, pod, metav1.CreateOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status reflects only the pod's container requests.ephemeral-storage")
+		usedResources[v1.ResourceRequestsEphemeralStorage] = resource.MustParse("30Gi")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Deleting the pod")
+		err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(ctx, pod.Name, *metav1.NewDeleteOptions(0))
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status released usage")
+		usedResources[v1.ResourceRequestsEphemeralStorage] = resource.MustParse("0")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+	})
+})
+
+var _ = SIGDescribe("ResourceQuota", func() {
+	f := framework.NewDefaultFramework("resourcequota-extended-resource")
+	f.NamespacePodSecurityLevel = admissionapi.LevelBaseline
+
+	ginkgo.It("should charge quota usage for an arbitrary extended resource advertised by a node", func(ctx context.Context) {
+		nodeList, err := f.ClientSet.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		framework.ExpectNoError(err)
+		if len(nodeList.Items) == 0 {
+			e2eskipper.Skipf("no nodes available to advertise a fake extended resource on")
+		}
+		nodeName := nodeList.Items[0].Name
+		arbitraryResourceName := v1.ResourceName("example.com/widget")
+
+		ginkgo.By(fmt.Sprintf("Registering a fake %s extended resource on node %s", arbitraryResourceName, nodeName))
+		removeExtendedResource, err := addExtendedResourceToNode(ctx, f.ClientSet, nodeName, arbitraryResourceName, "5")
+		framework.ExpectNoError(err)
+		ginkgo.DeferCleanup(removeExtendedResource)
+
+		ginkgo.By("Creating a ResourceQuota that hard-limits requests for the extended resource")
+		quotaName := "test-quota-extended-resource"
+		resourceQuota := newTestResourceQuota(quotaName)
+		requestsResourceName := v1.ResourceName(v1.DefaultResourceRequestsPrefix + string(arbitraryResourceName))
+		resourceQuota.Spec.Hard[requestsResourceName] = resource.MustParse("4")
+		_, err = createResourceQuota(ctx, f.ClientSet, f.Namespace.Name, resourceQuota)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status is calculated")
+		usedResources := v1.ResourceList{requestsResourceName: resource.MustParse("0")}
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Creating a pod that requests 3 widgets, which fits the quota")
+		requests := v1.ResourceList{arbitraryResourceName: resource.MustParse("3")}
+		limits := v1.ResourceList{arbitraryResourceName: resource.MustParse("3")}
+		pod := newTestPodForQuota(f, "test-pod-widgets", requests, limits)
+		pod, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(ctx, pod, metav1.CreateOptions{})
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status captures the pod's extended resource usage")
+		usedResources[requestsResourceName] = resource.MustParse("3")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Not allowing a second pod requesting 2 more widgets, which would exceed the remaining quota")
+		requests = v1.ResourceList{arbitraryResourceName: resource.MustParse("2")}
+		limits = v1.ResourceList{arbitraryResourceName: resource.MustParse("2")}
+		failPod := newTestPodForQuota(f, "test-pod-widgets-overflow", requests, limits)
+		_, err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Create(ctx, failPod, metav1.CreateOptions{})
+		framework.ExpectError(err)
+
+		ginkgo.By("Deleting the pod")
+		err = f.ClientSet.CoreV1().Pods(f.Namespace.Name).Delete(ctx, pod.Name, *metav1.NewDeleteOptions(0))
+		framework.ExpectNoError(err)
+
+		ginkgo.By("Ensuring resource quota status released the extended resource usage")
+		usedResources[requestsResourceName] = resource.MustParse("0")
+		err = waitForResourceQuota(ctx, f.ClientSet, f.Namespace.Name, quotaName, usedResources)
+		framework.ExpectNoError(err)
+	})
+})
+
 // newTestResourceQuotaWithScopeSelector returns a quota that enforces default constraints for testing with scopeSelectors
 func newTestResourceQuotaWithScopeSelector(name string, scope v1.ResourceQuotaScope) *v1.ResourceQuota {
 	hard := v1.ResourceList{}
@@ -1986,6 +2270,26 @@ func newTestPersistentVolumeClaimForQuota(name string) *v1.PersistentVolumeClaim
 	}
 }
 
+// newTestVolumeSnapshotForQuota returns a VolumeSnapshot sourced from the
+// named PersistentVolumeClaim, for the given VolumeSnapshotClass.
+func newTestVolumeSnapshotForQuota(name, snapshotClassName, sourcePVCName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "snapshot.storage.k8s.io/v1",
+			"kind":       "VolumeSnapshot",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"spec": map[string]interface{}{
+				"volumeSnapshotClassName": snapshotClassName,
+				"source": map[string]interface{}{
+					"persistentVolumeClaimName": sourcePVCName,
+				},
+			},
+		},
+	}
+}
+
 // newTestReplicationControllerForQuota returns a simple replication controller
 func newTestReplicationControllerForQuota(name, image string, replicas int32) *v1.ReplicationController {
 	return &v1.ReplicationController{
@@ -2089,6 +2393,29 @@ func newTestSecretForQuota(name string) *v1.Secret {
 	}
 }
 
+// addExtendedResourceToNode patches the named node's status to advertise
+// value units of an arbitrary extended resource in its capacity and
+// allocatable. It returns a cleanup function that removes
+// the advertised resource again.
+func addExtendedResourceToNode(ctx context.Context, c clientset.Interface, nodeName string, resourceName v1.ResourceName, value string) (func(), error) {
+	patchResourceName := strings.ReplaceAll(strings.ReplaceAll(string(resourceName), "~", "~0"), "/", "~1")
+	addPatch := []byte(fmt.Sprintf(
+		`[{"op": "add", "path": "/status/capacity/%s", "value": "%s"}, {"op": "add", "path": "/status/allocatable/%s", "value": "%s"}]`,
+		patchResourceName, value, patchResourceName, value))
+	_, err := c.CoreV1().Nodes().Patch(ctx, nodeName, types.JSONPatchType, addPatch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		removePatch := []byte(fmt.Sprintf(
+			`[{"op": "remove", "path": "/status/capacity/%s"}, {"op": "remove", "path": "/status/allocatable/%s"}]`,
+			patchResourceName, patchResourceName))
+		_, err := c.CoreV1().Nodes().Patch(ctx, nodeName, types.JSONPatchType, removePatch, metav1.PatchOptions{}, "status")
+		framework.ExpectNoError(err)
+	}
+	return cleanup, nil
+}
+
 // createResourceQuota in the specified namespace
 func createResourceQuota(ctx context.Context, c clientset.Interface, namespace string, resourceQuota *v1.ResourceQuota) (*v1.ResourceQuota, error) {
 	return c.CoreV1().ResourceQuotas(namespace).Create(ctx, resourceQuota, metav1.CreateOptions{})
@@ -2140,6 +2467,39 @@ func waitForResourceQuota(ctx context.Context, c clientset.Interface, ns, quotaN
 	})
 }
 
+// waitForPodResizeStatusFields polls the pod's first container status until
+// both its AllocatedResources (the node-allocated requests, which the
+// apiserver admits and records up front) and its Resources (the actually
+// running requests, which the kubelet only reports once it has actuated the
+// resize) agree with the given requests. AllocatedResources typically
+// reflects the new requests before Resources catches up, so callers see the
+// transient window between admission and actuation collapse before this
+// returns.
+func waitForPodResizeStatusFields(ctx context.Context, c clientset.Interface, ns, podName string, requests v1.ResourceList) error {
+	return wait.PollWithContext(ctx, framework.Poll, resourceQuotaTimeout, func(ctx context.Context) (bool, error) {
+		pod, err := c.CoreV1().Pods(ns).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if len(pod.Status.ContainerStatuses) == 0 {
+			return false, nil
+		}
+		containerStatus := pod.Status.ContainerStatuses[0]
+		if containerStatus.Resources == nil {
+			return false, nil
+		}
+		for name, want := range requests {
+			if got, found := containerStatus.AllocatedResources[name]; !found || got.Cmp(want) != 0 {
+				return false, nil
+			}
+			if got, found := containerStatus.Resources.Requests[name]; !found || got.Cmp(want) != 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
 // updateResourceQuotaUntilUsageAppears updates the resource quota object until the usage is populated
 // for the specific resource name.
 func updateResourceQuotaUntilUsageAppears(ctx context.Context, c clientset.Interface, ns, quotaName string, resourceName v1.ResourceName) error {